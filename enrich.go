@@ -0,0 +1,496 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/oschwald/geoip2-golang"
+)
+
+// -----------------
+// Enricher interface
+// -----------------
+
+// GeoInfo is what an Enricher knows about a single IP: location, network
+// ownership and a 0-100 abuse score used to decide whether to escalate.
+type GeoInfo struct {
+    Country      string
+    City         string
+    Lat          float64
+    Lon          float64
+    ASN          uint
+    Org          string
+    IsTor        bool
+    IsVPN        bool
+    IsDatacenter bool
+    AbuseScore   int
+}
+
+// Enricher looks up everything the server knows about an IP. Lookups sit
+// on the request path, so implementations must be fast (local mmdb reads)
+// or cached (remote API calls) rather than doing a network round trip per
+// request.
+type Enricher interface {
+    Enrich(ctx context.Context, ip string) (GeoInfo, error)
+}
+
+// noopEnricher is used when no backend is configured; every field stays
+// at its zero value.
+type noopEnricher struct{}
+
+func (noopEnricher) Enrich(ctx context.Context, ip string) (GeoInfo, error) {
+    return GeoInfo{}, nil
+}
+
+// -----------------
+// MaxMind GeoLite2 backend
+// -----------------
+
+// MaxMindEnricher serves geolocation and ASN data from local GeoLite2
+// .mmdb files. Both readers live behind an atomic.Pointer so Reload can
+// swap in freshly downloaded databases without a mutex on the read path,
+// and without ever serving a half-open file to a concurrent request.
+type MaxMindEnricher struct {
+    cityPath      string
+    asnPath       string
+    anonymousPath string
+
+    readers atomic.Pointer[mmdbReaders]
+}
+
+type mmdbReaders struct {
+    city      *geoip2.Reader
+    asn       *geoip2.Reader
+    anonymous *geoip2.Reader
+}
+
+// NewMaxMindEnricher opens the city, ASN and (optional) Anonymous-IP
+// databases at the given paths. asnPath/anonymousPath may be empty if
+// that data isn't available; the datacenter flag (IsHostingProvider)
+// lives on the Anonymous-IP/Enterprise record, not City, so it's only
+// populated when anonymousPath is set.
+func NewMaxMindEnricher(cityPath, asnPath, anonymousPath string) (*MaxMindEnricher, error) {
+    e := &MaxMindEnricher{cityPath: cityPath, asnPath: asnPath, anonymousPath: anonymousPath}
+    if err := e.Reload(); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// Reload re-opens every configured mmdb file and atomically swaps them
+// in, closing the previous readers once no in-flight lookup can still be
+// using them. Call this from a SIGHUP handler to pick up a refreshed
+// GeoLite2 release without restarting the process.
+func (e *MaxMindEnricher) Reload() error {
+    city, err := geoip2.Open(e.cityPath)
+    if err != nil {
+        return fmt.Errorf("open geoip city db: %w", err)
+    }
+    var asn *geoip2.Reader
+    if e.asnPath != "" {
+        asn, err = geoip2.Open(e.asnPath)
+        if err != nil {
+            city.Close()
+            return fmt.Errorf("open geoip asn db: %w", err)
+        }
+    }
+    var anonymous *geoip2.Reader
+    if e.anonymousPath != "" {
+        anonymous, err = geoip2.Open(e.anonymousPath)
+        if err != nil {
+            city.Close()
+            if asn != nil {
+                asn.Close()
+            }
+            return fmt.Errorf("open geoip anonymous-ip db: %w", err)
+        }
+    }
+
+    next := &mmdbReaders{city: city, asn: asn, anonymous: anonymous}
+    prev := e.readers.Swap(next)
+    if prev != nil {
+        prev.city.Close()
+        if prev.asn != nil {
+            prev.asn.Close()
+        }
+        if prev.anonymous != nil {
+            prev.anonymous.Close()
+        }
+    }
+    return nil
+}
+
+func (e *MaxMindEnricher) Enrich(ctx context.Context, ip string) (GeoInfo, error) {
+    readers := e.readers.Load()
+    if readers == nil {
+        return GeoInfo{}, fmt.Errorf("geoip: not initialized")
+    }
+    addr, err := parseIPForLookup(ip)
+    if err != nil {
+        return GeoInfo{}, err
+    }
+
+    var info GeoInfo
+    city, err := readers.city.City(addr)
+    if err != nil {
+        return GeoInfo{}, fmt.Errorf("geoip city lookup: %w", err)
+    }
+    info.Country = city.Country.IsoCode
+    info.City = city.City.Names["en"]
+    info.Lat = city.Location.Latitude
+    info.Lon = city.Location.Longitude
+
+    if readers.anonymous != nil {
+        anon, err := readers.anonymous.AnonymousIP(addr)
+        if err == nil {
+            info.IsDatacenter = anon.IsHostingProvider
+            info.IsVPN = anon.IsAnonymousVPN
+            info.IsTor = anon.IsTorExitNode
+        }
+    }
+
+    if readers.asn != nil {
+        asn, err := readers.asn.ASN(addr)
+        if err == nil {
+            info.ASN = asn.AutonomousSystemNumber
+            info.Org = asn.AutonomousSystemOrganization
+        }
+    }
+    return info, nil
+}
+
+// -----------------
+// Remote IPinfo/AbuseIPDB backend
+// -----------------
+
+// RemoteEnricher calls out to IPinfo for geolocation/ASN and AbuseIPDB for
+// the abuse score, behind a bounded LRU cache so repeat lookups of the
+// same IP (the common case for chatty clients) don't hammer either API.
+type RemoteEnricher struct {
+    ipinfoToken   string
+    abuseIPDBKey  string
+    client        *http.Client
+
+    cache *lruCache
+}
+
+// NewRemoteEnricher builds a RemoteEnricher with an LRU cache holding up
+// to cacheSize entries. Either token may be empty to skip that lookup.
+func NewRemoteEnricher(ipinfoToken, abuseIPDBKey string, client *http.Client, cacheSize int) *RemoteEnricher {
+    return &RemoteEnricher{
+        ipinfoToken:  ipinfoToken,
+        abuseIPDBKey: abuseIPDBKey,
+        client:       client,
+        cache:        newLRUCache(cacheSize),
+    }
+}
+
+func (e *RemoteEnricher) Enrich(ctx context.Context, ip string) (GeoInfo, error) {
+    if cached, ok := e.cache.get(ip); ok {
+        return cached, nil
+    }
+
+    var info GeoInfo
+    if e.ipinfoToken != "" {
+        if err := e.fetchIPInfo(ctx, ip, &info); err != nil {
+            return GeoInfo{}, err
+        }
+    }
+    if e.abuseIPDBKey != "" {
+        if err := e.fetchAbuseScore(ctx, ip, &info); err != nil {
+            return GeoInfo{}, err
+        }
+    }
+
+    e.cache.put(ip, info)
+    return info, nil
+}
+
+func (e *RemoteEnricher) fetchIPInfo(ctx context.Context, ip string, info *GeoInfo) error {
+    url := fmt.Sprintf("https://ipinfo.io/%s/json?token=%s", ip, e.ipinfoToken)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := e.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("ipinfo: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("ipinfo: unexpected status %d", resp.StatusCode)
+    }
+
+    var body struct {
+        Country string `json:"country"`
+        City    string `json:"city"`
+        Loc     string `json:"loc"` // "lat,lon"
+        Org     string `json:"org"` // "AS15169 Google LLC"
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return fmt.Errorf("ipinfo: decode: %w", err)
+    }
+
+    info.Country = body.Country
+    info.City = body.City
+    if lat, lon, ok := strings.Cut(body.Loc, ","); ok {
+        if f, err := strconv.ParseFloat(lat, 64); err == nil {
+            info.Lat = f
+        }
+        if f, err := strconv.ParseFloat(lon, 64); err == nil {
+            info.Lon = f
+        }
+    }
+    if asn, org, ok := strings.Cut(body.Org, " "); ok {
+        info.Org = org
+        if n, err := strconv.Atoi(strings.TrimPrefix(asn, "AS")); err == nil {
+            info.ASN = uint(n)
+        }
+    }
+    return nil
+}
+
+func (e *RemoteEnricher) fetchAbuseScore(ctx context.Context, ip string, info *GeoInfo) error {
+    url := fmt.Sprintf("https://api.abuseipdb.com/api/v2/check?ipAddress=%s&maxAgeInDays=90", ip)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Key", e.abuseIPDBKey)
+    req.Header.Set("Accept", "application/json")
+    resp, err := e.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("abuseipdb: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("abuseipdb: unexpected status %d", resp.StatusCode)
+    }
+
+    var body struct {
+        Data struct {
+            AbuseConfidenceScore int  `json:"abuseConfidenceScore"`
+            IsTor                bool `json:"isTor"`
+            UsageType             string `json:"usageType"`
+        } `json:"data"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return fmt.Errorf("abuseipdb: decode: %w", err)
+    }
+
+    info.AbuseScore = body.Data.AbuseConfidenceScore
+    info.IsTor = body.Data.IsTor
+    if strings.EqualFold(body.Data.UsageType, "datacenter") {
+        info.IsDatacenter = true
+    }
+    return nil
+}
+
+// -----------------
+// Composite
+// -----------------
+
+// CompositeEnricher merges a fast local lookup (geolocation/ASN) with a
+// slower remote lookup (abuse score), so a deployment can run MaxMind
+// alone, AbuseIPDB alone, or both.
+type CompositeEnricher struct {
+    local  Enricher
+    remote Enricher
+}
+
+// Reloader is implemented by enrichers that can refresh their underlying
+// data in place, e.g. MaxMindEnricher re-opening an updated mmdb file.
+// BuildEnricher callers that want SIGHUP-triggered reloads should type
+// assert against this instead of a concrete enricher type, since local
+// may end up wrapped in a CompositeEnricher.
+type Reloader interface {
+    Reload() error
+}
+
+// Reload forwards to local if it's reloadable, so a SIGHUP handler
+// installed against a CompositeEnricher still reaches the wrapped
+// MaxMindEnricher.
+func (e *CompositeEnricher) Reload() error {
+    if r, ok := e.local.(Reloader); ok {
+        return r.Reload()
+    }
+    return nil
+}
+
+func (e *CompositeEnricher) Enrich(ctx context.Context, ip string) (GeoInfo, error) {
+    info, err := e.local.Enrich(ctx, ip)
+    if err != nil {
+        return GeoInfo{}, err
+    }
+    remoteInfo, err := e.remote.Enrich(ctx, ip)
+    if err != nil {
+        return info, err
+    }
+    if remoteInfo.AbuseScore != 0 {
+        info.AbuseScore = remoteInfo.AbuseScore
+    }
+    if remoteInfo.IsTor {
+        info.IsTor = true
+    }
+    if remoteInfo.IsDatacenter {
+        info.IsDatacenter = true
+    }
+    if info.Country == "" {
+        info.Country = remoteInfo.Country
+    }
+    if info.Org == "" {
+        info.Org = remoteInfo.Org
+    }
+    return info, nil
+}
+
+func parseIPForLookup(ip string) (net.IP, error) {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return nil, fmt.Errorf("invalid ip %q", ip)
+    }
+    return addr, nil
+}
+
+// -----------------
+// Bounded LRU cache
+// -----------------
+
+// lruCache is a small hand-rolled LRU so RemoteEnricher doesn't pull in a
+// dependency just to bound memory use for a map[string]GeoInfo.
+type lruCache struct {
+    mu       sync.Mutex
+    capacity int
+    items    map[string]*list.Element
+    order    *list.List
+}
+
+type lruEntry struct {
+    key   string
+    value GeoInfo
+}
+
+func newLRUCache(capacity int) *lruCache {
+    if capacity <= 0 {
+        capacity = 1024
+    }
+    return &lruCache{
+        capacity: capacity,
+        items:    make(map[string]*list.Element),
+        order:    list.New(),
+    }
+}
+
+func (c *lruCache) get(key string) (GeoInfo, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[key]
+    if !ok {
+        return GeoInfo{}, false
+    }
+    c.order.MoveToFront(el)
+    return el.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) put(key string, value GeoInfo) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.items[key]; ok {
+        el.Value.(*lruEntry).value = value
+        c.order.MoveToFront(el)
+        return
+    }
+    el := c.order.PushFront(&lruEntry{key: key, value: value})
+    c.items[key] = el
+    if c.order.Len() > c.capacity {
+        oldest := c.order.Back()
+        if oldest != nil {
+            c.order.Remove(oldest)
+            delete(c.items, oldest.Value.(*lruEntry).key)
+        }
+    }
+}
+
+// -----------------
+// Denylist
+// -----------------
+
+// Denylist is an in-memory, TTL-bounded set of blocked IPs. Entries expire
+// lazily on read rather than via a background sweep, so an expired entry
+// stays in memory until its IP is looked up again.
+type Denylist struct {
+    mu      sync.Mutex
+    entries map[string]time.Time // ip -> expiry
+}
+
+// NewDenylist returns an empty denylist.
+func NewDenylist() *Denylist {
+    return &Denylist{entries: make(map[string]time.Time)}
+}
+
+// Add blocks ip for ttl.
+func (d *Denylist) Add(ip string, ttl time.Duration) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.entries[ip] = time.Now().Add(ttl)
+}
+
+// Blocked reports whether ip is currently denylisted, cleaning up the
+// entry if its TTL has since expired.
+func (d *Denylist) Blocked(ip string) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    expiry, ok := d.entries[ip]
+    if !ok {
+        return false
+    }
+    if time.Now().After(expiry) {
+        delete(d.entries, ip)
+        return false
+    }
+    return true
+}
+
+// -----------------
+// Backend selection
+// -----------------
+
+// BuildEnricher picks an Enricher implementation from cfg. Any combination
+// of GEOIP_CITY_DB / GEOIP_ASN_DB / GEOIP_ANON_DB and IPINFO_TOKEN /
+// ABUSEIPDB_KEY may be set; BuildEnricher composes whichever backends are
+// configured, and returns a noopEnricher if none are.
+func BuildEnricher(cfg AppConfig, httpc *http.Client) (Enricher, error) {
+    var local Enricher
+    if cfg.GeoIPCityDB != "" {
+        mm, err := NewMaxMindEnricher(cfg.GeoIPCityDB, cfg.GeoIPASNDB, cfg.GeoIPAnonDB)
+        if err != nil {
+            return nil, err
+        }
+        local = mm
+    }
+
+    var remote Enricher
+    if cfg.IPInfoToken != "" || cfg.AbuseIPDBKey != "" {
+        remote = NewRemoteEnricher(cfg.IPInfoToken, cfg.AbuseIPDBKey, httpc, cfg.EnrichCacheSize)
+    }
+
+    switch {
+    case local != nil && remote != nil:
+        return &CompositeEnricher{local: local, remote: remote}, nil
+    case local != nil:
+        return local, nil
+    case remote != nil:
+        return remote, nil
+    default:
+        return noopEnricher{}, nil
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestLRUCacheGetMiss(t *testing.T) {
+    c := newLRUCache(2)
+    if _, ok := c.get("missing"); ok {
+        t.Fatalf("get on empty cache returned ok=true")
+    }
+}
+
+func TestLRUCachePutGet(t *testing.T) {
+    c := newLRUCache(2)
+    c.put("a", GeoInfo{Country: "US"})
+    got, ok := c.get("a")
+    if !ok {
+        t.Fatalf("get(a) missing after put")
+    }
+    if got.Country != "US" {
+        t.Fatalf("get(a).Country = %q, want US", got.Country)
+    }
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+    c := newLRUCache(2)
+    c.put("a", GeoInfo{Country: "A"})
+    c.put("b", GeoInfo{Country: "B"})
+    // Touch "a" so it's no longer the least recently used.
+    if _, ok := c.get("a"); !ok {
+        t.Fatalf("get(a) missing")
+    }
+    c.put("c", GeoInfo{Country: "C"})
+
+    if _, ok := c.get("b"); ok {
+        t.Fatalf("get(b) should have been evicted")
+    }
+    if _, ok := c.get("a"); !ok {
+        t.Fatalf("get(a) should still be present")
+    }
+    if _, ok := c.get("c"); !ok {
+        t.Fatalf("get(c) should be present")
+    }
+}
+
+func TestLRUCacheOverwriteUpdatesValue(t *testing.T) {
+    c := newLRUCache(2)
+    c.put("a", GeoInfo{Country: "A"})
+    c.put("a", GeoInfo{Country: "A2"})
+    got, ok := c.get("a")
+    if !ok || got.Country != "A2" {
+        t.Fatalf("get(a) = %+v, ok=%v, want Country=A2", got, ok)
+    }
+}
+
+func TestNewLRUCacheDefaultsNonPositiveCapacity(t *testing.T) {
+    c := newLRUCache(0)
+    if c.capacity != 1024 {
+        t.Fatalf("capacity = %d, want default 1024", c.capacity)
+    }
+}
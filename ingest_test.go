@@ -0,0 +1,81 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func sign(secret string, ts int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(fmt.Sprintf("%d.", ts)))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignatureValid(t *testing.T) {
+    secret := "s3cr3t"
+    body := []byte(`{"username":"alice"}`)
+    now := time.Unix(1_700_000_000, 0)
+    header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign(secret, now.Unix(), body))
+
+    if err := verifySignature(header, secret, body, now); err != nil {
+        t.Fatalf("verifySignature returned error for a valid signature: %v", err)
+    }
+}
+
+func TestVerifySignatureWrongSecret(t *testing.T) {
+    body := []byte(`{"username":"alice"}`)
+    now := time.Unix(1_700_000_000, 0)
+    header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign("right-secret", now.Unix(), body))
+
+    if err := verifySignature(header, "wrong-secret", body, now); err == nil {
+        t.Fatalf("verifySignature accepted a signature made with a different secret")
+    }
+}
+
+func TestVerifySignatureTamperedBody(t *testing.T) {
+    secret := "s3cr3t"
+    now := time.Unix(1_700_000_000, 0)
+    header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign(secret, now.Unix(), []byte(`{"username":"alice"}`)))
+
+    if err := verifySignature(header, secret, []byte(`{"username":"mallory"}`), now); err == nil {
+        t.Fatalf("verifySignature accepted a tampered body")
+    }
+}
+
+func TestVerifySignatureOutsideSkew(t *testing.T) {
+    secret := "s3cr3t"
+    body := []byte(`{}`)
+    signedAt := time.Unix(1_700_000_000, 0)
+    now := signedAt.Add(signatureSkew + time.Minute)
+    header := fmt.Sprintf("t=%d,v1=%s", signedAt.Unix(), sign(secret, signedAt.Unix(), body))
+
+    if err := verifySignature(header, secret, body, now); err == nil {
+        t.Fatalf("verifySignature accepted a timestamp outside the skew window")
+    }
+}
+
+func TestVerifySignatureWithinSkew(t *testing.T) {
+    secret := "s3cr3t"
+    body := []byte(`{}`)
+    signedAt := time.Unix(1_700_000_000, 0)
+    now := signedAt.Add(signatureSkew - time.Second)
+    header := fmt.Sprintf("t=%d,v1=%s", signedAt.Unix(), sign(secret, signedAt.Unix(), body))
+
+    if err := verifySignature(header, secret, body, now); err != nil {
+        t.Fatalf("verifySignature rejected a timestamp just inside the skew window: %v", err)
+    }
+}
+
+func TestVerifySignatureMalformedHeader(t *testing.T) {
+    cases := []string{"", "t=abc", "v1=deadbeef", "garbage"}
+    for _, h := range cases {
+        if err := verifySignature(h, "secret", []byte("{}"), time.Now()); err == nil {
+            t.Fatalf("verifySignature accepted malformed header %q", h)
+        }
+    }
+}
@@ -1,28 +1,33 @@
 package main
 
 import (
-    "bytes"
+    "context"
     "crypto/rand"
     "encoding/json"
     "errors"
     "fmt"
     "io"
-    "net"
     "net/http"
     "os"
+    "os/signal"
     "strconv"
     "strings"
-    "sync"
+    "syscall"
     "time"
 )
 
 // Simple API logger server
 // - POST /login accepts JSON payload with client metadata
+// - POST /ingest/{event_type} generalizes /login: configurable JSON Schema
+//   validation and HMAC-signed requests per event type (see IngestConfig)
 // - Adds server metadata (ip, timestamp, uuid)
 // - Masks sensitive fields (e.g., password, token) recursively
-// - Appends one JSON object per line to logs.jsonl
-// - Sends short notifications to Discord webhook and Telegram bot
+// - Persists entries through a pluggable LogStore (JSONL, SQLite or ClickHouse)
+// - GET /logs and /logs/stats query that store
+// - Fans out notifications to pluggable sinks (Discord, Telegram, Slack, ...)
 // - Rate limits by IP
+// - Enriches events with GeoIP/ASN/abuse data before logging and notifying
+// - Exposes /metrics (Prometheus) and traces handlers/limiter/notifiers via OpenTelemetry
 
 // ---------------------------
 // Configuration & .env loader
@@ -32,8 +37,82 @@ type AppConfig struct {
     DiscordWebhookURL string
     TelegramBotToken  string
     TelegramChatID    string
-    RateLimit         int           // requests per window
-    RateWindow        time.Duration // window duration
+
+    SlackWebhookURL string
+
+    MatrixHomeserverURL string
+    MatrixAccessToken   string
+    MatrixRoomID        string
+
+    SMTPAddr     string
+    SMTPUsername string
+    SMTPPassword string
+    SMTPFrom     string
+    SMTPTo       []string
+    SMTPSubject  string
+
+    WebhookURL    string
+    WebhookSecret string
+
+    // NotifyConfigPath optionally points at a YAML file with per-sink
+    // timeout/retry/template overrides. See NotifyFileConfig.
+    NotifyConfigPath string
+
+    // LogStoreBackend selects the LogStore implementation: "jsonl"
+    // (default), "sqlite" or "clickhouse".
+    LogStoreBackend  string
+    LogDir           string
+    SQLitePath       string
+    ClickHouseDSN    string
+    LogBatchSize     int
+    LogFlushInterval time.Duration
+
+    // RateLimitBackend selects the Limiter implementation: "memory"
+    // (default) or "redis" for multi-instance deployments.
+    RateLimitBackend string
+    RedisAddr        string
+    RateBurst        int     // token bucket capacity
+    RateRefillPerSec float64 // tokens refilled per second
+
+    // TrustedProxies lists the CIDRs allowed to set X-Forwarded-For,
+    // X-Real-IP or Forwarded; requests from anywhere else have those
+    // headers ignored. See getClientIP.
+    TrustedProxies TrustedProxies
+
+    // GeoIPCityDB/GeoIPASNDB/GeoIPAnonDB point at local MaxMind GeoLite2
+    // .mmdb files. Leave GeoIPCityDB empty to disable local enrichment.
+    // GeoIPAnonDB (the Anonymous-IP database) is optional and, when set,
+    // is the only local source for the IsDatacenter/IsVPN/IsTor flags; the
+    // remote AbuseIPDB lookup can also set IsTor and IsDatacenter.
+    GeoIPCityDB string
+    GeoIPASNDB  string
+    GeoIPAnonDB string
+
+    // IPInfoToken/AbuseIPDBKey enable the optional remote enrichment
+    // backend; leave empty to skip that lookup.
+    IPInfoToken     string
+    AbuseIPDBKey    string
+    EnrichCacheSize int
+
+    // AbuseScoreThreshold: events at or above this score get
+    // Event.HighPriority set and the IP is added to the in-memory
+    // denylist for DenylistTTL. Zero disables the check.
+    AbuseScoreThreshold int
+    DenylistTTL         time.Duration
+
+    // AbuseAlertWebhookURL/Secret register an extra, high-priority-only
+    // webhook sink for abuse-scored events. See BuildDispatcher.
+    AbuseAlertWebhookURL    string
+    AbuseAlertWebhookSecret string
+
+    // OTLPEndpoint points tracing at an OTLP/HTTP collector (e.g.
+    // Jaeger/Tempo). Empty disables exporting; spans are still created
+    // but go nowhere.
+    OTLPEndpoint string
+
+    // IngestConfigPath optionally points at a YAML file describing the
+    // event types POST /ingest/{event_type} accepts. See IngestConfig.
+    IngestConfigPath string
 }
 
 // loadDotEnv loads a basic .env file from the given path into the process environment.
@@ -88,49 +167,6 @@ func getenv(key, def string) string {
     return def
 }
 
-// -----------------
-// Rate limit by IP
-// -----------------
-
-type visitor struct {
-    count   int
-    resetAt time.Time
-}
-
-type RateLimiter struct {
-    mu       sync.Mutex
-    visitors map[string]*visitor
-    limit    int
-    window   time.Duration
-}
-
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-    return &RateLimiter{
-        visitors: make(map[string]*visitor),
-        limit:    limit,
-        window:   window,
-    }
-}
-
-// Allow returns whether the request is allowed for the given IP and the time until reset.
-func (rl *RateLimiter) Allow(ip string) (bool, time.Duration) {
-    now := time.Now()
-    rl.mu.Lock()
-    defer rl.mu.Unlock()
-
-    v, ok := rl.visitors[ip]
-    if !ok || now.After(v.resetAt) {
-        rl.visitors[ip] = &visitor{count: 1, resetAt: now.Add(rl.window)}
-        return true, rl.window
-    }
-
-    if v.count < rl.limit {
-        v.count++
-        return true, time.Until(v.resetAt)
-    }
-    return false, time.Until(v.resetAt)
-}
-
 // ------------------
 // Sensitive masking
 // ------------------
@@ -184,27 +220,6 @@ func maskSensitive(v interface{}) interface{} {
 // Utility functions
 // -----------------
 
-func getClientIP(r *http.Request) string {
-    // Prefer X-Forwarded-For if present
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        parts := strings.Split(xff, ",")
-        if len(parts) > 0 {
-            ip := strings.TrimSpace(parts[0])
-            if ip != "" {
-                return ip
-            }
-        }
-    }
-    if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-        return strings.TrimSpace(xrip)
-    }
-    host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
-    if err == nil && host != "" {
-        return host
-    }
-    return r.RemoteAddr
-}
-
 func uuidV4() (string, error) {
     var b [16]byte
     if _, err := rand.Read(b[:]); err != nil {
@@ -223,142 +238,38 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
     _ = json.NewEncoder(w).Encode(v)
 }
 
-// -----------------
-// JSONL file append
-// -----------------
-
-var (
-    logFilePath = "logs.jsonl"
-    logMu       sync.Mutex
-)
-
-func appendJSONLine(path string, v interface{}) error {
-    logMu.Lock()
-    defer logMu.Unlock()
-
-    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
-    if err != nil {
-        return err
-    }
-    defer f.Close()
-
-    enc := json.NewEncoder(f)
-    // No pretty-printing for JSONL; one compact object per line
-    return enc.Encode(v)
-}
-
-// -------------------------
-// Discord/Telegram sending
-// -------------------------
-
-func sendDiscord(webhookURL, content string, client *http.Client) error {
-    if webhookURL == "" {
-        return nil
-    }
-    payload := map[string]string{"content": content}
-    body, _ := json.Marshal(payload)
-    req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
-    if err != nil {
-        return err
-    }
-    req.Header.Set("Content-Type", "application/json")
-    resp, err := client.Do(req)
-    if err != nil {
-        return err
-    }
-    defer resp.Body.Close()
-    // Discord webhooks often return 204 No Content on success
-    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-        return fmt.Errorf("discord webhook failed: %d %s", resp.StatusCode, string(b))
-    }
-    return nil
-}
-
-func sendTelegram(token, chatID, content string, client *http.Client) error {
-    if token == "" || chatID == "" {
-        return nil
-    }
-    url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token)
-    payload := map[string]interface{}{
-        "chat_id":                chatID,
-        "text":                   content,
-        "disable_web_page_preview": true,
-    }
-    body, _ := json.Marshal(payload)
-    req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-    if err != nil {
-        return err
-    }
-    req.Header.Set("Content-Type", "application/json")
-    resp, err := client.Do(req)
-    if err != nil {
-        return err
-    }
-    defer resp.Body.Close()
-    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-        b, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
-        return fmt.Errorf("telegram sendMessage failed: %d %s", resp.StatusCode, string(b))
-    }
-    return nil
-}
-
-func composeBriefMessage(username, ip, platform, lang string, screenW, screenH int, timestamp string) string {
-    var b strings.Builder
-    b.WriteString("Nouvelle connexion :\n")
-    if username != "" {
-        b.WriteString("- user: ")
-        b.WriteString(username)
-        b.WriteString("\n")
-    }
-    if ip != "" {
-        b.WriteString("- ip: ")
-        b.WriteString(ip)
-        b.WriteString("\n")
-    }
-    if platform != "" {
-        b.WriteString("- os: ")
-        b.WriteString(platform)
-        b.WriteString("\n")
-    }
-    if lang != "" {
-        b.WriteString("- lang: ")
-        b.WriteString(lang)
-        b.WriteString("\n")
-    }
-    if screenW > 0 && screenH > 0 {
-        b.WriteString("- screen: ")
-        b.WriteString(strconv.Itoa(screenW))
-        b.WriteString("x")
-        b.WriteString(strconv.Itoa(screenH))
-        b.WriteString("\n")
-    }
-    if timestamp != "" {
-        b.WriteString("- time: ")
-        b.WriteString(timestamp)
-        b.WriteString("\n")
-    }
-    return b.String()
-}
-
 // -----------------
 // HTTP handlers
 // -----------------
 
 type server struct {
-    cfg      AppConfig
-    limiter  *RateLimiter
-    httpc    *http.Client
-    maxBytes int64
+    cfg        AppConfig
+    limiter    Limiter
+    httpc      *http.Client
+    dispatcher *Dispatcher
+    store        LogStore
+    enricher     Enricher
+    denylist     *Denylist
+    ingestConfig map[string]*EventTypeConfig
+    maxBytes     int64
 }
 
 func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
+    ctx, span := tracer.Start(r.Context(), "loginHandler")
+    defer span.End()
+    r = r.WithContext(ctx)
+
     if r.Method != http.MethodPost {
         writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed"})
         return
     }
 
-    ip := getClientIP(r)
+    ip := getClientIP(r, s.cfg.TrustedProxies)
+
+    if s.denylist != nil && s.denylist.Blocked(ip) {
+        writeJSON(w, http.StatusForbidden, map[string]string{"error": "ip_blocked"})
+        return
+    }
 
     // Limit request body to a reasonable size (1 MiB)
     r.Body = http.MaxBytesReader(w, r.Body, s.maxBytes)
@@ -391,35 +302,76 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
     sw := toInt(screen["width"]) // may be nil
     sh := toInt(screen["height"])
 
-    // Build log entry
-    logEntry := map[string]interface{}{
-        "id":        id,
-        "timestamp": ts,
-        "ip":        ip,
-        "path":      "/login",
-        "method":    r.Method,
-        "client":    payload,
+    // Enrich with geolocation/ASN/abuse data before persisting or notifying,
+    // so both the log entry and the notification template see the same
+    // picture of who's on the other end of ip. A lookup failure is not
+    // fatal: the request still gets logged with whatever fields we have.
+    geo, err := s.enricher.Enrich(r.Context(), ip)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "enrich %s: %v\n", ip, err)
+    }
+    highPriority := s.cfg.AbuseScoreThreshold > 0 && geo.AbuseScore >= s.cfg.AbuseScoreThreshold
+    if highPriority && s.denylist != nil {
+        s.denylist.Add(ip, s.cfg.DenylistTTL)
     }
 
-    if err := appendJSONLine(logFilePath, logEntry); err != nil {
+    // Build log entry
+    parsedTS, err := time.Parse(time.RFC3339, ts)
+    if err != nil {
+        parsedTS = time.Now().UTC()
+    }
+    logEntry := Entry{
+        ID:        id,
+        Timestamp: parsedTS,
+        IP:        ip,
+        Path:      "/login",
+        Method:    r.Method,
+        Username:  username,
+        Platform:  platform,
+        Client:    payload,
+
+        Country:      geo.Country,
+        City:         geo.City,
+        Lat:          geo.Lat,
+        Lon:          geo.Lon,
+        ASN:          geo.ASN,
+        Org:          geo.Org,
+        IsTor:        geo.IsTor,
+        IsVPN:        geo.IsVPN,
+        IsDatacenter: geo.IsDatacenter,
+        AbuseScore:   geo.AbuseScore,
+    }
+
+    if err := s.store.Append(r.Context(), logEntry); err != nil {
         // Fail softly: log to stderr, respond 500
+        logAppendErrorsTotal.Inc()
+        span.RecordError(err)
         fmt.Fprintf(os.Stderr, "failed to write log: %v\n", err)
         writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal_error"})
         return
     }
 
-    // Send notifications (best-effort)
-    msg := composeBriefMessage(username, ip, platform, lang, sw, sh, ts)
-    go func() {
-        if err := sendDiscord(s.cfg.DiscordWebhookURL, msg, s.httpc); err != nil {
-            fmt.Fprintf(os.Stderr, "discord notify error: %v\n", err)
-        }
-    }()
-    go func() {
-        if err := sendTelegram(s.cfg.TelegramBotToken, s.cfg.TelegramChatID, msg, s.httpc); err != nil {
-            fmt.Fprintf(os.Stderr, "telegram notify error: %v\n", err)
-        }
-    }()
+    // Fan the event out to every configured notification sink. Notify only
+    // enqueues onto each sink's bounded worker queue, so this never blocks
+    // on a slow or unreachable backend.
+    s.dispatcher.Notify(Event{
+        ID:        id,
+        Timestamp: ts,
+        IP:        ip,
+        Username:  username,
+        Platform:  platform,
+        Language:  lang,
+        ScreenW:   sw,
+        ScreenH:   sh,
+        Path:      "/login",
+        Raw:       payload,
+
+        Country:      geo.Country,
+        Org:          geo.Org,
+        IsTor:        geo.IsTor,
+        AbuseScore:   geo.AbuseScore,
+        HighPriority: highPriority,
+    })
 
     // Respond to client
     writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -432,11 +384,26 @@ func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 // rateLimitMiddleware enforces per-IP limits before reaching the handler
 func (s *server) rateLimitMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        ip := getClientIP(r)
-        allowed, retryIn := s.limiter.Allow(ip)
-        if !allowed {
-            // RFC-compliant Retry-After (seconds)
-            secs := int(retryIn.Seconds())
+        ctx, span := tracer.Start(r.Context(), "rateLimitMiddleware")
+        defer span.End()
+        r = r.WithContext(ctx)
+
+        ip := getClientIP(r, s.cfg.TrustedProxies)
+        decision, err := s.limiter.Allow(r.Context(), ip)
+        if err != nil {
+            // A limiter outage must not take down the login path: fail open.
+            fmt.Fprintf(os.Stderr, "rate limiter error: %v\n", err)
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+        w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+        w.Header().Set("RateLimit-Reset", strconv.Itoa(int(time.Until(decision.ResetAt).Seconds())))
+
+        if !decision.Allowed {
+            ratelimitRejectedTotal.WithLabelValues(ipClass(ip)).Inc()
+            secs := int(decision.RetryAfter.Seconds())
             if secs < 1 {
                 secs = 1
             }
@@ -451,6 +418,90 @@ func (s *server) rateLimitMiddleware(next http.Handler) http.Handler {
     })
 }
 
+// logsHandler serves GET /logs?ip=&from=&to=&user=&limit=&cursor= with
+// cursor-based pagination over whatever LogStore backend is configured.
+func (s *server) logsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed"})
+        return
+    }
+
+    q := r.URL.Query()
+    filter := Filter{
+        IP:     q.Get("ip"),
+        User:   q.Get("user"),
+        Cursor: q.Get("cursor"),
+    }
+    if v := q.Get("limit"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil {
+            filter.Limit = n
+        }
+    }
+    if v := q.Get("from"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_from"})
+            return
+        }
+        filter.From = t
+    }
+    if v := q.Get("to"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_to"})
+            return
+        }
+        filter.To = t
+    }
+
+    res, err := s.store.Query(r.Context(), filter)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "logs query error: %v\n", err)
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal_error"})
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "entries":     res.Entries,
+        "next_cursor": res.NextCursor,
+    })
+}
+
+// logsStatsHandler serves GET /logs/stats?from=&to=, aggregate counts by
+// IP and platform over the given window (defaults to the last 24h).
+func (s *server) logsStatsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed"})
+        return
+    }
+
+    q := r.URL.Query()
+    filter := Filter{From: time.Now().UTC().Add(-24 * time.Hour)}
+    if v := q.Get("from"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_from"})
+            return
+        }
+        filter.From = t
+    }
+    if v := q.Get("to"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_to"})
+            return
+        }
+        filter.To = t
+    }
+
+    stats, err := s.store.Stats(r.Context(), filter)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "logs stats error: %v\n", err)
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal_error"})
+        return
+    }
+    writeJSON(w, http.StatusOK, stats)
+}
+
 // Helpers to safely extract typed values from generic maps
 func getMap(m map[string]interface{}, key string) map[string]interface{} {
     if m == nil {
@@ -520,30 +571,173 @@ func main() {
         DiscordWebhookURL: getenv("DISCORD_WEBHOOK_URL", ""),
         TelegramBotToken:  getenv("TELEGRAM_BOT_TOKEN", ""),
         TelegramChatID:    getenv("TELEGRAM_CHAT_ID", ""),
-        RateLimit:         5,
-        RateWindow:        time.Minute,
+
+        SlackWebhookURL: getenv("SLACK_WEBHOOK_URL", ""),
+
+        MatrixHomeserverURL: getenv("MATRIX_HOMESERVER_URL", ""),
+        MatrixAccessToken:   getenv("MATRIX_ACCESS_TOKEN", ""),
+        MatrixRoomID:        getenv("MATRIX_ROOM_ID", ""),
+
+        SMTPAddr:     getenv("SMTP_ADDR", ""),
+        SMTPUsername: getenv("SMTP_USERNAME", ""),
+        SMTPPassword: getenv("SMTP_PASSWORD", ""),
+        SMTPFrom:     getenv("SMTP_FROM", ""),
+        SMTPSubject:  getenv("SMTP_SUBJECT", ""),
+
+        WebhookURL:    getenv("WEBHOOK_URL", ""),
+        WebhookSecret: getenv("WEBHOOK_SECRET", ""),
+
+        NotifyConfigPath: getenv("NOTIFY_CONFIG_FILE", ""),
+
+        LogStoreBackend: getenv("LOG_STORE_BACKEND", "jsonl"),
+        LogDir:          getenv("LOG_DIR", "logs"),
+        SQLitePath:      getenv("SQLITE_PATH", "logs.db"),
+        ClickHouseDSN:   getenv("CLICKHOUSE_DSN", ""),
+
+        RateLimitBackend: getenv("RATE_LIMIT_BACKEND", "memory"),
+        RedisAddr:        getenv("REDIS_ADDR", ""),
+        RateBurst:        5,
+        RateRefillPerSec: 5.0 / 60, // 5 requests per minute, matching the old default
+
+        GeoIPCityDB: getenv("GEOIP_CITY_DB", ""),
+        GeoIPASNDB:  getenv("GEOIP_ASN_DB", ""),
+        GeoIPAnonDB: getenv("GEOIP_ANON_DB", ""),
+
+        IPInfoToken:  getenv("IPINFO_TOKEN", ""),
+        AbuseIPDBKey: getenv("ABUSEIPDB_KEY", ""),
+
+        DenylistTTL: 1 * time.Hour,
+
+        AbuseAlertWebhookURL:    getenv("ABUSE_ALERT_WEBHOOK_URL", ""),
+        AbuseAlertWebhookSecret: getenv("ABUSE_ALERT_WEBHOOK_SECRET", ""),
+
+        OTLPEndpoint: getenv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+
+        IngestConfigPath: getenv("INGEST_CONFIG_FILE", ""),
+    }
+    if v := getenv("LOG_BATCH_SIZE", ""); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            cfg.LogBatchSize = n
+        }
+    }
+    if v := getenv("LOG_FLUSH_INTERVAL_MS", ""); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            cfg.LogFlushInterval = time.Duration(n) * time.Millisecond
+        }
+    }
+    if v := getenv("SMTP_TO", ""); v != "" {
+        cfg.SMTPTo = strings.Split(v, ",")
+        for i := range cfg.SMTPTo {
+            cfg.SMTPTo[i] = strings.TrimSpace(cfg.SMTPTo[i])
+        }
     }
 
-    if v := getenv("RATE_LIMIT", ""); v != "" {
+    if v := getenv("RATE_BURST", ""); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            cfg.RateBurst = n
+        }
+    }
+    if v := getenv("RATE_REFILL_PER_SEC", ""); v != "" {
+        if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+            cfg.RateRefillPerSec = f
+        }
+    }
+    if v := getenv("TRUSTED_PROXIES", ""); v != "" {
+        proxies, err := parseTrustedProxies(v)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "config: %v\n", err)
+            os.Exit(1)
+        }
+        cfg.TrustedProxies = proxies
+    }
+    if v := getenv("ENRICH_CACHE_SIZE", ""); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 {
+            cfg.EnrichCacheSize = n
+        }
+    }
+    if v := getenv("ABUSE_SCORE_THRESHOLD", ""); v != "" {
         if n, err := strconv.Atoi(v); err == nil && n > 0 {
-            cfg.RateLimit = n
+            cfg.AbuseScoreThreshold = n
         }
     }
-    if v := getenv("RATE_WINDOW_SECONDS", ""); v != "" {
+    if v := getenv("DENYLIST_TTL_SEC", ""); v != "" {
         if n, err := strconv.Atoi(v); err == nil && n > 0 {
-            cfg.RateWindow = time.Duration(n) * time.Second
+            cfg.DenylistTTL = time.Duration(n) * time.Second
+        }
+    }
+
+    shutdownTracer, err := initTracer(context.Background(), cfg.OTLPEndpoint)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "tracing: %v\n", err)
+        os.Exit(1)
+    }
+    defer func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := shutdownTracer(ctx); err != nil {
+            fmt.Fprintf(os.Stderr, "tracing shutdown: %v\n", err)
         }
+    }()
+
+    httpc := &http.Client{
+        Timeout: 5 * time.Second,
+    }
+
+    store, err := BuildLogStore(cfg)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "log store: %v\n", err)
+        os.Exit(1)
+    }
+
+    limiter, err := BuildLimiter(cfg)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "rate limiter: %v\n", err)
+        os.Exit(1)
+    }
+
+    enricher, err := BuildEnricher(cfg, httpc)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "enricher: %v\n", err)
+        os.Exit(1)
+    }
+    if reloadable, ok := enricher.(Reloader); ok {
+        // SIGHUP reloads the mmdb files in place, so a refreshed GeoLite2
+        // release can be dropped onto disk without restarting the server.
+        // enricher may be a bare *MaxMindEnricher or one wrapped in a
+        // *CompositeEnricher (e.g. MaxMind + AbuseIPDB); both satisfy
+        // Reloader, so this fires either way.
+        go func() {
+            hupCh := make(chan os.Signal, 1)
+            signal.Notify(hupCh, syscall.SIGHUP)
+            for range hupCh {
+                if err := reloadable.Reload(); err != nil {
+                    fmt.Fprintf(os.Stderr, "geoip reload: %v\n", err)
+                }
+            }
+        }()
+    }
+
+    ingestConfig, err := loadIngestConfig(cfg.IngestConfigPath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "ingest config: %v\n", err)
+        os.Exit(1)
     }
 
     srv := &server{
-        cfg:     cfg,
-        limiter: NewRateLimiter(cfg.RateLimit, cfg.RateWindow),
-        httpc: &http.Client{
-            Timeout: 5 * time.Second,
-        },
-        maxBytes: 1 << 20, // 1 MiB
+        cfg:          cfg,
+        limiter:      limiter,
+        httpc:        httpc,
+        dispatcher:   BuildDispatcher(cfg, httpc),
+        store:        store,
+        enricher:     enricher,
+        denylist:     NewDenylist(),
+        ingestConfig: ingestConfig,
+        maxBytes:     1 << 20, // 1 MiB
     }
 
+    stopVisitorsGauge := make(chan struct{})
+    startVisitorsGaugeLoop(limiter, 5*time.Second, stopVisitorsGauge)
+
     mux := http.NewServeMux()
 
     // Health endpoint (optional)
@@ -551,9 +745,20 @@ func main() {
         writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
     })
 
+    mux.Handle("/metrics", metricsHandler)
+
     // /login with rate limiting
-    login := http.HandlerFunc(srv.loginHandler)
-    mux.Handle("/login", srv.rateLimitMiddleware(login))
+    login := metricsMiddleware("/login", tracedHandler("/login", srv.rateLimitMiddleware(http.HandlerFunc(srv.loginHandler))))
+    mux.Handle("/login", login)
+
+    mux.Handle("/logs", metricsMiddleware("/logs", tracedHandler("/logs", http.HandlerFunc(srv.logsHandler))))
+    mux.Handle("/logs/stats", metricsMiddleware("/logs/stats", tracedHandler("/logs/stats", http.HandlerFunc(srv.logsStatsHandler))))
+
+    // /ingest/{event_type}, the generalized successor to /login. Rate
+    // limiting applies here too: it's still an unauthenticated-by-default
+    // endpoint for any event_type without its own signing secret.
+    ingest := metricsMiddleware("/ingest", tracedHandler("/ingest", srv.rateLimitMiddleware(http.HandlerFunc(srv.ingestHandler))))
+    mux.Handle("/ingest/", ingest)
 
     httpSrv := &http.Server{
         Addr:         ":8080",
@@ -563,10 +768,29 @@ func main() {
         IdleTimeout:  60 * time.Second,
     }
 
+    // On SIGINT/SIGTERM, stop accepting new connections and let in-flight
+    // requests finish before we fsync and close the log store below.
+    go func() {
+        sigCh := make(chan os.Signal, 1)
+        signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+        <-sigCh
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := httpSrv.Shutdown(ctx); err != nil {
+            fmt.Fprintf(os.Stderr, "server shutdown: %v\n", err)
+        }
+    }()
+
     fmt.Println("API logger server listening on http://localhost:8080 â€¦")
     if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
         fmt.Fprintf(os.Stderr, "server error: %v\n", err)
         os.Exit(1)
     }
+
+    close(stopVisitorsGauge)
+
+    if err := store.Close(); err != nil {
+        fmt.Fprintf(os.Stderr, "log store close: %v\n", err)
+    }
 }
 
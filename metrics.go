@@ -0,0 +1,129 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -----------------
+// Prometheus metrics
+// -----------------
+
+// These are the metrics an operator scrapes GET /metrics for. Names and
+// label sets are part of the dashboard/alerting contract, so don't rename
+// them without updating whatever Grafana boards read them.
+var (
+    requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "azurepulse_requests_total",
+        Help: "Total HTTP requests handled, labeled by path/method/status.",
+    }, []string{"path", "method", "status"})
+
+    requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "azurepulse_request_duration_seconds",
+        Help:    "HTTP request latency in seconds.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"path", "method"})
+
+    ratelimitRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "azurepulse_ratelimit_rejected_total",
+        Help: "Requests rejected by the rate limiter, labeled by ip_class (private/public).",
+    }, []string{"ip_class"})
+
+    notifyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "azurepulse_notify_total",
+        Help: "Notification attempts, labeled by sink and result (ok/error).",
+    }, []string{"sink", "result"})
+
+    notifyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "azurepulse_notify_duration_seconds",
+        Help:    "Time spent delivering a notification to a sink, including retries.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"sink"})
+
+    logAppendErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "azurepulse_log_append_errors_total",
+        Help: "Failed LogStore.Append calls.",
+    })
+
+    visitorsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+        Name: "azurepulse_visitors_gauge",
+        Help: "Distinct keys currently tracked by the in-memory rate limiter.",
+    })
+)
+
+// metricsHandler serves GET /metrics in the Prometheus text exposition
+// format.
+var metricsHandler = promhttp.Handler()
+
+// ipClass buckets an IP into "private" or "public" for the
+// ratelimit_rejected_total label, so a dashboard can separate internal
+// traffic (misconfigured service, health checker) from real abuse.
+func ipClass(ip string) string {
+    addr := net.ParseIP(ip)
+    if addr != nil && (addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast()) {
+        return "private"
+    }
+    return "public"
+}
+
+// statusRecorder wraps a ResponseWriter to capture the status code for
+// requestsTotal/requestDuration, since http.ResponseWriter doesn't expose
+// what was already written.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+    r.status = status
+    r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware records azurepulse_requests_total and
+// azurepulse_request_duration_seconds for every request, regardless of
+// which handler or middleware further down the chain serves it.
+func metricsMiddleware(path string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        start := time.Now()
+        next.ServeHTTP(rec, r)
+        requestDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+        requestsTotal.WithLabelValues(path, r.Method, strconv.Itoa(rec.status)).Inc()
+    })
+}
+
+// visitorCounter is implemented by limiters that can report how many
+// distinct keys they're currently tracking (today, just
+// TokenBucketLimiter; RedisLimiter shares state externally so there's no
+// local count to report).
+type visitorCounter interface {
+    VisitorCount() int
+}
+
+// startVisitorsGaugeLoop polls limiter for its visitor count every
+// interval and publishes it as azurepulse_visitors_gauge, until stop is
+// closed. No-op if limiter doesn't implement visitorCounter.
+func startVisitorsGaugeLoop(limiter Limiter, interval time.Duration, stop <-chan struct{}) {
+    vc, ok := limiter.(visitorCounter)
+    if !ok {
+        return
+    }
+    ticker := time.NewTicker(interval)
+    go func() {
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                visitorsGauge.Set(float64(vc.VisitorCount()))
+            case <-stop:
+                return
+            }
+        }
+    }()
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/smtp"
+    "net/url"
+    "os"
+    "strings"
+    "text/template"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// -------------------------------
+// Notifier interface & dispatcher
+// -------------------------------
+
+// Event is the normalized payload handed to every notification sink.
+// It mirrors the fields historically pulled out of the login payload by
+// composeBriefMessage, plus the raw client payload for templates that want
+// more than the common fields.
+type Event struct {
+    ID        string
+    Timestamp string
+    IP        string
+    Username  string
+    Platform  string
+    Language  string
+    ScreenW   int
+    ScreenH   int
+    Path      string
+    Raw       map[string]interface{}
+
+    // Enrichment, filled in by the configured Enricher before Notify is
+    // called. Empty/zero when enrichment is disabled or failed.
+    Country      string
+    Org          string
+    IsTor        bool
+    AbuseScore   int
+    HighPriority bool
+}
+
+// Notifier delivers an Event to a single external sink.
+type Notifier interface {
+    Name() string
+    Notify(ctx context.Context, ev Event) error
+}
+
+// SinkConfig controls how the dispatcher drives a registered Notifier:
+// how long delivering one event may take across all of its attempts, how
+// many times to retry a failure with exponential backoff, and how many
+// events may be queued for the sink's worker before new events are dropped.
+type SinkConfig struct {
+    Enabled      bool
+    Timeout      time.Duration
+    RetryMax     int
+    RetryBackoff time.Duration
+    QueueSize    int
+    Template     string
+
+    // HighPriorityOnly restricts this sink to events with HighPriority
+    // set, e.g. a dedicated abuse-alert channel that shouldn't see every
+    // ordinary login.
+    HighPriorityOnly bool
+}
+
+// DefaultSinkConfig returns sane defaults for a sink that wasn't given
+// explicit tuning in env/YAML.
+func DefaultSinkConfig() SinkConfig {
+    return SinkConfig{
+        Enabled:      true,
+        Timeout:      5 * time.Second,
+        RetryMax:     3,
+        RetryBackoff: 500 * time.Millisecond,
+        QueueSize:    64,
+        Template:     defaultTemplate,
+    }
+}
+
+type registeredSink struct {
+    notifier Notifier
+    cfg      SinkConfig
+    queue    chan Event
+}
+
+// Dispatcher fans an Event out to every registered Notifier. Each sink has
+// its own bounded queue and worker goroutine, so a slow or unreachable
+// backend (e.g. a Matrix homeserver that's timing out) can't block the
+// others or the request path that called Notify.
+type Dispatcher struct {
+    sinks []*registeredSink
+}
+
+// NewDispatcher returns an empty dispatcher; use Register to add sinks.
+func NewDispatcher() *Dispatcher {
+    return &Dispatcher{}
+}
+
+// Register adds a sink and starts its worker goroutine.
+func (d *Dispatcher) Register(n Notifier, cfg SinkConfig) {
+    if cfg.Template == "" {
+        cfg.Template = defaultTemplate
+    }
+    if cfg.QueueSize <= 0 {
+        cfg.QueueSize = 64
+    }
+    rs := &registeredSink{notifier: n, cfg: cfg, queue: make(chan Event, cfg.QueueSize)}
+    d.sinks = append(d.sinks, rs)
+    go d.runWorker(rs)
+}
+
+func (d *Dispatcher) runWorker(rs *registeredSink) {
+    for ev := range rs.queue {
+        ctx, cancel := context.WithTimeout(context.Background(), rs.cfg.Timeout)
+        ctx, span := tracer.Start(ctx, "notify."+rs.notifier.Name())
+        start := time.Now()
+        err := notifyWithRetry(ctx, rs.notifier, rs.cfg, ev)
+        notifyDuration.WithLabelValues(rs.notifier.Name()).Observe(time.Since(start).Seconds())
+        if err != nil {
+            notifyTotal.WithLabelValues(rs.notifier.Name(), "error").Inc()
+            span.RecordError(err)
+            fmt.Fprintf(os.Stderr, "%s notify error: %v\n", rs.notifier.Name(), err)
+        } else {
+            notifyTotal.WithLabelValues(rs.notifier.Name(), "ok").Inc()
+        }
+        span.End()
+        cancel()
+    }
+}
+
+// notifyWithRetry drives a single sink with exponential backoff between
+// attempts. The per-attempt deadline is whatever's left on ctx.
+func notifyWithRetry(ctx context.Context, n Notifier, cfg SinkConfig, ev Event) error {
+    backoff := cfg.RetryBackoff
+    var lastErr error
+    for attempt := 0; attempt <= cfg.RetryMax; attempt++ {
+        if lastErr = n.Notify(ctx, ev); lastErr == nil {
+            return nil
+        }
+        if attempt == cfg.RetryMax {
+            break
+        }
+        select {
+        case <-time.After(backoff):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+        backoff *= 2
+    }
+    return fmt.Errorf("%s: giving up after %d attempt(s): %w", n.Name(), cfg.RetryMax+1, lastErr)
+}
+
+// Notify enqueues ev on every enabled sink. A full queue drops the event
+// for that sink (logged) rather than blocking the caller; the request path
+// must never wait on an external webhook.
+func (d *Dispatcher) Notify(ev Event) {
+    for _, rs := range d.sinks {
+        if !rs.cfg.Enabled {
+            continue
+        }
+        if rs.cfg.HighPriorityOnly && !ev.HighPriority {
+            continue
+        }
+        select {
+        case rs.queue <- ev:
+        default:
+            fmt.Fprintf(os.Stderr, "%s notify queue full, dropping event %s\n", rs.notifier.Name(), ev.ID)
+        }
+    }
+}
+
+// ----------------
+// Message template
+// ----------------
+
+const defaultTemplate = `{{if .HighPriority}}[HIGH PRIORITY] {{end}}New login:
+{{- if .Username}}
+- user: {{.Username}}{{end}}
+{{- if .IP}}
+- ip: {{.IP}}{{end}}
+{{- if .Platform}}
+- os: {{.Platform}}{{end}}
+{{- if .Language}}
+- lang: {{.Language}}{{end}}
+{{- if and .ScreenW .ScreenH}}
+- screen: {{.ScreenW}}x{{.ScreenH}}{{end}}
+{{- if .Country}}
+- geo: {{.Country}}{{if .Org}} / {{.Org}}{{end}}{{if .IsTor}} / Tor exit{{end}}{{end}}
+{{- if .AbuseScore}}
+- abuse score: {{.AbuseScore}}{{end}}
+{{- if .Timestamp}}
+- time: {{.Timestamp}}{{end}}
+`
+
+func renderTemplate(tmplText string, ev Event) (string, error) {
+    tmpl, err := template.New("notify").Parse(tmplText)
+    if err != nil {
+        return "", fmt.Errorf("parse template: %w", err)
+    }
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, ev); err != nil {
+        return "", fmt.Errorf("execute template: %w", err)
+    }
+    return buf.String(), nil
+}
+
+// ----------------
+// Discord & Telegram
+// ----------------
+
+type DiscordNotifier struct {
+    WebhookURL string
+    Template   string
+    Client     *http.Client
+}
+
+func (n *DiscordNotifier) Name() string { return "discord" }
+
+func (n *DiscordNotifier) Notify(ctx context.Context, ev Event) error {
+    return sendDiscord(ctx, n.WebhookURL, ev.renderedOr(n.Template), n.Client)
+}
+
+// sendDiscord posts content to a Discord incoming webhook.
+func sendDiscord(ctx context.Context, webhookURL, content string, client *http.Client) error {
+    if webhookURL == "" {
+        return nil
+    }
+    body, _ := json.Marshal(map[string]string{"content": content})
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    injectTraceparent(ctx, req)
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    // Discord webhooks often return 204 No Content on success
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("discord webhook failed: %d %s", resp.StatusCode, string(b))
+    }
+    return nil
+}
+
+type TelegramNotifier struct {
+    Token    string
+    ChatID   string
+    Template string
+    Client   *http.Client
+}
+
+func (n *TelegramNotifier) Name() string { return "telegram" }
+
+func (n *TelegramNotifier) Notify(ctx context.Context, ev Event) error {
+    return sendTelegram(ctx, n.Token, n.ChatID, ev.renderedOr(n.Template), n.Client)
+}
+
+// sendTelegram posts content as a message from a Telegram bot.
+func sendTelegram(ctx context.Context, token, chatID, content string, client *http.Client) error {
+    if token == "" || chatID == "" {
+        return nil
+    }
+    apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token)
+    body, _ := json.Marshal(map[string]interface{}{
+        "chat_id":                  chatID,
+        "text":                     content,
+        "disable_web_page_preview": true,
+    })
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    injectTraceparent(ctx, req)
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+        return fmt.Errorf("telegram sendMessage failed: %d %s", resp.StatusCode, string(b))
+    }
+    return nil
+}
+
+// ----------------
+// Slack
+// ----------------
+
+// SlackNotifier posts to a Slack incoming webhook URL.
+type SlackNotifier struct {
+    WebhookURL string
+    Template   string
+    Client     *http.Client
+}
+
+func (n *SlackNotifier) Name() string { return "slack" }
+
+func (n *SlackNotifier) Notify(ctx context.Context, ev Event) error {
+    if n.WebhookURL == "" {
+        return nil
+    }
+    content := ev.renderedOr(n.Template)
+    body, _ := json.Marshal(map[string]string{"text": content})
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    injectTraceparent(ctx, req)
+    resp, err := n.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("slack webhook failed: %d %s", resp.StatusCode, string(b))
+    }
+    return nil
+}
+
+// ----------------
+// Matrix
+// ----------------
+
+// MatrixNotifier sends an m.room.message event via the Matrix client-server API.
+type MatrixNotifier struct {
+    HomeserverURL string
+    AccessToken   string
+    RoomID        string
+    Template      string
+    Client        *http.Client
+}
+
+func (n *MatrixNotifier) Name() string { return "matrix" }
+
+func (n *MatrixNotifier) Notify(ctx context.Context, ev Event) error {
+    if n.HomeserverURL == "" || n.AccessToken == "" || n.RoomID == "" {
+        return nil
+    }
+    content := ev.renderedOr(n.Template)
+    txnID, err := uuidV4()
+    if err != nil {
+        txnID = fmt.Sprintf("txn-%d", time.Now().UnixNano())
+    }
+    endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+        strings.TrimRight(n.HomeserverURL, "/"), url.PathEscape(n.RoomID), txnID)
+    body, _ := json.Marshal(map[string]string{"msgtype": "m.text", "body": content})
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+n.AccessToken)
+    injectTraceparent(ctx, req)
+    resp, err := n.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("matrix send failed: %d %s", resp.StatusCode, string(b))
+    }
+    return nil
+}
+
+// ----------------
+// SMTP email
+// ----------------
+
+// SMTPNotifier emails the rendered message to a fixed set of recipients.
+type SMTPNotifier struct {
+    Addr     string // host:port
+    Username string
+    Password string
+    From     string
+    To       []string
+    Subject  string
+    Template string
+}
+
+func (n *SMTPNotifier) Name() string { return "smtp" }
+
+func (n *SMTPNotifier) Notify(ctx context.Context, ev Event) error {
+    if n.Addr == "" || n.From == "" || len(n.To) == 0 {
+        return nil
+    }
+    content := ev.renderedOr(n.Template)
+    subject := n.Subject
+    if subject == "" {
+        subject = "AzurePulse notification"
+    }
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
+        n.From, strings.Join(n.To, ", "), subject, content)
+
+    host := n.Addr
+    if idx := strings.LastIndex(n.Addr, ":"); idx != -1 {
+        host = n.Addr[:idx]
+    }
+    var auth smtp.Auth
+    if n.Username != "" {
+        auth = smtp.PlainAuth("", n.Username, n.Password, host)
+    }
+
+    done := make(chan error, 1)
+    go func() { done <- smtp.SendMail(n.Addr, auth, n.From, n.To, []byte(msg)) }()
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// ----------------
+// Generic signed webhook
+// ----------------
+
+// WebhookNotifier POSTs a JSON body to an arbitrary URL, signing it with
+// HMAC-SHA256 over the raw body and carrying the hex digest in
+// X-Signature, matching the pattern used by typical chat-bot bridges.
+type WebhookNotifier struct {
+    URL      string
+    Secret   string
+    Template string
+    Client   *http.Client
+}
+
+func (n *WebhookNotifier) Name() string { return "webhook" }
+
+func (n *WebhookNotifier) Notify(ctx context.Context, ev Event) error {
+    if n.URL == "" {
+        return nil
+    }
+    content := ev.renderedOr(n.Template)
+    body, _ := json.Marshal(map[string]string{
+        "event_id": ev.ID,
+        "message":  content,
+    })
+
+    mac := hmac.New(sha256.New, []byte(n.Secret))
+    mac.Write(body)
+    signature := hex.EncodeToString(mac.Sum(nil))
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Signature", signature)
+    injectTraceparent(ctx, req)
+    resp, err := n.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("webhook failed: %d %s", resp.StatusCode, string(b))
+    }
+    return nil
+}
+
+// renderedOr renders the event with tmplText, falling back to a minimal
+// "user/ip" line if the template fails to parse or execute so a sink
+// config typo never silently swallows a notification.
+func (ev Event) renderedOr(tmplText string) string {
+    if tmplText == "" {
+        tmplText = defaultTemplate
+    }
+    s, err := renderTemplate(tmplText, ev)
+    if err != nil {
+        return fmt.Sprintf("login: user=%s ip=%s (template error: %v)", ev.Username, ev.IP, err)
+    }
+    return s
+}
+
+// ----------------
+// Registry / config loading
+// ----------------
+
+// NotifyFileConfig is the shape of the optional YAML file pointed to by
+// NOTIFY_CONFIG_FILE. It lets an operator tune per-sink timeout, retry and
+// template settings beyond what the flat env vars in AppConfig expose.
+// Sinks not present here fall back to DefaultSinkConfig.
+type NotifyFileConfig struct {
+    Sinks map[string]struct {
+        Enabled          *bool  `yaml:"enabled"`
+        TimeoutMS        int    `yaml:"timeout_ms"`
+        RetryMax         int    `yaml:"retry_max"`
+        BackoffMS        int    `yaml:"backoff_ms"`
+        QueueSize        int    `yaml:"queue_size"`
+        Template         string `yaml:"template"`
+        TemplateFile     string `yaml:"template_file"`
+        HighPriorityOnly bool   `yaml:"high_priority_only"`
+    } `yaml:"sinks"`
+}
+
+// loadNotifyFileConfig reads and parses the optional per-sink tuning file.
+// A missing path is not an error: the caller falls back to env-only config.
+func loadNotifyFileConfig(path string) (*NotifyFileConfig, error) {
+    if path == "" {
+        return nil, nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("read notify config: %w", err)
+    }
+    var cfg NotifyFileConfig
+    if err := yaml.Unmarshal(data, &cfg); err != nil {
+        return nil, fmt.Errorf("parse notify config %s: %w", path, err)
+    }
+    return &cfg, nil
+}
+
+// sinkConfigFor merges DefaultSinkConfig with any per-sink overrides found
+// in the optional YAML file for the sink named by key.
+func sinkConfigFor(file *NotifyFileConfig, key string) SinkConfig {
+    cfg := DefaultSinkConfig()
+    if file == nil {
+        return cfg
+    }
+    override, ok := file.Sinks[key]
+    if !ok {
+        return cfg
+    }
+    if override.Enabled != nil {
+        cfg.Enabled = *override.Enabled
+    }
+    if override.TimeoutMS > 0 {
+        cfg.Timeout = time.Duration(override.TimeoutMS) * time.Millisecond
+    }
+    if override.RetryMax > 0 {
+        cfg.RetryMax = override.RetryMax
+    }
+    if override.BackoffMS > 0 {
+        cfg.RetryBackoff = time.Duration(override.BackoffMS) * time.Millisecond
+    }
+    if override.QueueSize > 0 {
+        cfg.QueueSize = override.QueueSize
+    }
+    if override.TemplateFile != "" {
+        if b, err := os.ReadFile(override.TemplateFile); err == nil {
+            cfg.Template = string(b)
+        } else {
+            fmt.Fprintf(os.Stderr, "notify: reading template_file for %s: %v\n", key, err)
+        }
+    } else if override.Template != "" {
+        cfg.Template = override.Template
+    }
+    cfg.HighPriorityOnly = override.HighPriorityOnly
+    return cfg
+}
+
+// BuildDispatcher wires up every configured sink from cfg (env-derived)
+// plus optional per-sink overrides from cfg.NotifyConfigPath (YAML), and
+// registers them on a fresh Dispatcher.
+func BuildDispatcher(cfg AppConfig, httpc *http.Client) *Dispatcher {
+    file, err := loadNotifyFileConfig(cfg.NotifyConfigPath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "notify: %v (continuing with env-only config)\n", err)
+    }
+
+    d := NewDispatcher()
+
+    discordCfg := sinkConfigFor(file, "discord")
+    d.Register(&DiscordNotifier{WebhookURL: cfg.DiscordWebhookURL, Template: discordCfg.Template, Client: httpc}, discordCfg)
+
+    telegramCfg := sinkConfigFor(file, "telegram")
+    d.Register(&TelegramNotifier{Token: cfg.TelegramBotToken, ChatID: cfg.TelegramChatID, Template: telegramCfg.Template, Client: httpc}, telegramCfg)
+
+    slackCfg := sinkConfigFor(file, "slack")
+    d.Register(&SlackNotifier{WebhookURL: cfg.SlackWebhookURL, Template: slackCfg.Template, Client: httpc}, slackCfg)
+
+    matrixCfg := sinkConfigFor(file, "matrix")
+    d.Register(&MatrixNotifier{
+        HomeserverURL: cfg.MatrixHomeserverURL,
+        AccessToken:   cfg.MatrixAccessToken,
+        RoomID:        cfg.MatrixRoomID,
+        Template:      matrixCfg.Template,
+        Client:        httpc,
+    }, matrixCfg)
+
+    smtpCfg := sinkConfigFor(file, "smtp")
+    d.Register(&SMTPNotifier{
+        Addr:     cfg.SMTPAddr,
+        Username: cfg.SMTPUsername,
+        Password: cfg.SMTPPassword,
+        From:     cfg.SMTPFrom,
+        To:       cfg.SMTPTo,
+        Subject:  cfg.SMTPSubject,
+        Template: smtpCfg.Template,
+    }, smtpCfg)
+
+    webhookCfg := sinkConfigFor(file, "webhook")
+    d.Register(&WebhookNotifier{URL: cfg.WebhookURL, Secret: cfg.WebhookSecret, Template: webhookCfg.Template, Client: httpc}, webhookCfg)
+
+    if cfg.AbuseAlertWebhookURL != "" {
+        abuseCfg := sinkConfigFor(file, "abuse_alert")
+        abuseCfg.HighPriorityOnly = true
+        d.Register(&WebhookNotifier{URL: cfg.AbuseAlertWebhookURL, Secret: cfg.AbuseAlertWebhookSecret, Template: abuseCfg.Template, Client: httpc}, abuseCfg)
+    }
+
+    return d
+}
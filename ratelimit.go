@@ -0,0 +1,384 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "net/netip"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// -----------------
+// Limiter interface
+// -----------------
+
+// Decision is the outcome of a single Allow call, carrying everything
+// needed to set the standard RateLimit-* response headers.
+type Decision struct {
+    Allowed    bool
+    Limit      int
+    Remaining  int
+    ResetAt    time.Time
+    RetryAfter time.Duration
+}
+
+// Limiter decides whether the caller identified by key may proceed. The
+// in-memory implementation is per-process; the Redis implementation shares
+// state across every API instance pointed at the same Redis server.
+type Limiter interface {
+    Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// -----------------
+// In-memory token bucket
+// -----------------
+
+type tokenBucket struct {
+    tokens     float64
+    lastRefill time.Time
+}
+
+// bucketIdleTTL is how long a key's bucket can sit untouched before a
+// sweep reclaims it. A bucket that's been idle this long has long since
+// refilled to full, so dropping it loses no rate-limiting state -- the
+// next Allow just starts it fresh, identically to a brand new key.
+const bucketIdleTTL = 10 * time.Minute
+
+// TokenBucketLimiter is a classic token bucket per key: each key starts
+// with burst tokens, refills continuously at refillRate tokens/sec up to
+// burst, and every Allow call costs one token. Idle buckets are swept
+// periodically so memory doesn't grow without bound as distinct keys
+// (client IPs) come and go.
+type TokenBucketLimiter struct {
+    mu         sync.Mutex
+    buckets    map[string]*tokenBucket
+    burst      int
+    refillRate float64 // tokens per second
+
+    stop chan struct{}
+}
+
+// NewTokenBucketLimiter builds an in-memory limiter with the given burst
+// capacity and refill rate, and starts a background goroutine that evicts
+// buckets idle longer than bucketIdleTTL.
+func NewTokenBucketLimiter(burst int, refillRate float64) *TokenBucketLimiter {
+    l := &TokenBucketLimiter{
+        buckets:    make(map[string]*tokenBucket),
+        burst:      burst,
+        refillRate: refillRate,
+        stop:       make(chan struct{}),
+    }
+    go l.sweepLoop()
+    return l
+}
+
+func (l *TokenBucketLimiter) sweepLoop() {
+    ticker := time.NewTicker(bucketIdleTTL)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            l.sweep(time.Now())
+        case <-l.stop:
+            return
+        }
+    }
+}
+
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for key, b := range l.buckets {
+        if now.Sub(b.lastRefill) >= bucketIdleTTL {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// Close stops the background sweep goroutine.
+func (l *TokenBucketLimiter) Close() error {
+    close(l.stop)
+    return nil
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+    now := time.Now()
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: float64(l.burst), lastRefill: now}
+        l.buckets[key] = b
+    }
+
+    elapsed := now.Sub(b.lastRefill).Seconds()
+    b.tokens = math.Min(float64(l.burst), b.tokens+elapsed*l.refillRate)
+    b.lastRefill = now
+
+    allowed := b.tokens >= 1
+    if allowed {
+        b.tokens--
+    }
+
+    missing := float64(l.burst) - b.tokens
+    resetIn := time.Duration(missing/l.refillRate*float64(time.Second))
+    retryAfter := time.Duration(1 / l.refillRate * float64(time.Second))
+
+    return Decision{
+        Allowed:    allowed,
+        Limit:      l.burst,
+        Remaining:  int(b.tokens),
+        ResetAt:    now.Add(resetIn),
+        RetryAfter: retryAfter,
+    }, nil
+}
+
+// VisitorCount reports how many distinct keys currently have a bucket,
+// backing the azurepulse_visitors_gauge metric.
+func (l *TokenBucketLimiter) VisitorCount() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return len(l.buckets)
+}
+
+// -----------------
+// Redis-backed token bucket
+// -----------------
+
+// tokenBucketScript atomically reads, refills and debits a bucket stored
+// as a Redis hash, so multiple API instances sharing a Redis server never
+// race on the same key. Returns {allowed, tokens_remaining, ttl_seconds}.
+const tokenBucketScript = `
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+
+if tokens == nil then
+  tokens = capacity
+  ts = now
+end
+
+local elapsed = math.max(0, now - ts) / 1000
+tokens = math.min(capacity, tokens + elapsed * rate)
+
+local allowed = 0
+if tokens >= requested then
+  allowed = 1
+  tokens = tokens - requested
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', now)
+local ttl = math.ceil(capacity / rate) + 1
+redis.call('EXPIRE', KEYS[1], ttl)
+
+return {allowed, math.floor(tokens), ttl}
+`
+
+// RedisLimiter is a Limiter backed by Redis, so every API instance behind
+// a load balancer enforces the same bucket per key.
+type RedisLimiter struct {
+    rdb        *redis.Client
+    script     *redis.Script
+    burst      int
+    refillRate float64
+    prefix     string
+}
+
+// NewRedisLimiter connects to the Redis instance at addr.
+func NewRedisLimiter(addr string, burst int, refillRate float64) *RedisLimiter {
+    return &RedisLimiter{
+        rdb:        redis.NewClient(&redis.Options{Addr: addr}),
+        script:     redis.NewScript(tokenBucketScript),
+        burst:      burst,
+        refillRate: refillRate,
+        prefix:     "azurepulse:ratelimit:",
+    }
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+    now := time.Now().UnixMilli()
+    res, err := l.script.Run(ctx, l.rdb, []string{l.prefix + key}, l.burst, l.refillRate, now, 1).Result()
+    if err != nil {
+        return Decision{}, fmt.Errorf("redis ratelimit: %w", err)
+    }
+
+    vals, ok := res.([]interface{})
+    if !ok || len(vals) != 3 {
+        return Decision{}, fmt.Errorf("redis ratelimit: unexpected script result %v", res)
+    }
+    allowed, _ := vals[0].(int64)
+    remaining, _ := vals[1].(int64)
+    ttl, _ := vals[2].(int64)
+
+    return Decision{
+        Allowed:    allowed == 1,
+        Limit:      l.burst,
+        Remaining:  int(remaining),
+        ResetAt:    time.Now().Add(time.Duration(ttl) * time.Second),
+        RetryAfter: time.Duration(1 / l.refillRate * float64(time.Second)),
+    }, nil
+}
+
+// Close releases the underlying Redis connection pool.
+func (l *RedisLimiter) Close() error {
+    return l.rdb.Close()
+}
+
+// -----------------
+// Trusted-proxy-aware client IP extraction
+// -----------------
+
+// TrustedProxies is the set of CIDRs allowed to set forwarding headers.
+// A request whose RemoteAddr doesn't fall in here has its headers ignored
+// entirely -- RemoteAddr is the client, full stop.
+type TrustedProxies []netip.Prefix
+
+// Contains reports whether addr falls inside any configured prefix.
+func (tp TrustedProxies) Contains(addr netip.Addr) bool {
+    for _, prefix := range tp {
+        if prefix.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs
+// (treated as /32 or /128) from config.
+func parseTrustedProxies(csv string) (TrustedProxies, error) {
+    var out TrustedProxies
+    for _, part := range strings.Split(csv, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        if prefix, err := netip.ParsePrefix(part); err == nil {
+            out = append(out, prefix)
+            continue
+        }
+        addr, err := netip.ParseAddr(part)
+        if err != nil {
+            return nil, fmt.Errorf("invalid trusted proxy %q", part)
+        }
+        out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+    }
+    return out, nil
+}
+
+// getClientIP returns the real client IP for r. Forwarding headers
+// (Forwarded, X-Forwarded-For, X-Real-IP) are only honored when
+// RemoteAddr itself is inside trusted; otherwise a caller could simply
+// claim to be anyone by sending its own X-Forwarded-For.
+func getClientIP(r *http.Request, trusted TrustedProxies) string {
+    remoteHost, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+    if err != nil {
+        remoteHost = strings.TrimSpace(r.RemoteAddr)
+    }
+
+    remoteAddr, err := netip.ParseAddr(remoteHost)
+    if err != nil || !trusted.Contains(remoteAddr) {
+        if remoteHost != "" {
+            return remoteHost
+        }
+        return r.RemoteAddr
+    }
+
+    if fwd := r.Header.Get("Forwarded"); fwd != "" {
+        if ip := parseForwardedHeader(fwd, trusted); ip != "" {
+            return ip
+        }
+    }
+    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+        if ip := firstUntrustedHop(xff, trusted); ip != "" {
+            return ip
+        }
+    }
+    if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
+        return strings.TrimSpace(xrip)
+    }
+    return remoteHost
+}
+
+// firstUntrustedHop walks a comma-separated X-Forwarded-For list
+// right-to-left and returns the first hop that isn't itself a trusted
+// proxy: that's the earliest entry nobody we trust vouched for, i.e. the
+// real client. Unparsable entries are skipped rather than trusted blindly.
+func firstUntrustedHop(xff string, trusted TrustedProxies) string {
+    parts := strings.Split(xff, ",")
+    for i := len(parts) - 1; i >= 0; i-- {
+        candidate := strings.TrimSpace(parts[i])
+        addr, err := netip.ParseAddr(candidate)
+        if err != nil {
+            continue
+        }
+        if !trusted.Contains(addr) {
+            return candidate
+        }
+    }
+    return ""
+}
+
+// parseForwardedHeader extracts the right-to-left first-untrusted "for="
+// value from an RFC 7239 Forwarded header, e.g.
+// `Forwarded: for=192.0.2.1;proto=https, for=198.51.100.2`.
+func parseForwardedHeader(header string, trusted TrustedProxies) string {
+    var fors []string
+    for _, part := range strings.Split(header, ",") {
+        for _, kv := range strings.Split(part, ";") {
+            kv = strings.TrimSpace(kv)
+            if !strings.HasPrefix(strings.ToLower(kv), "for=") {
+                continue
+            }
+            val := strings.TrimSpace(kv[len("for="):])
+            val = strings.Trim(val, `"`)
+            val = strings.TrimPrefix(val, "[")
+            val = strings.TrimSuffix(val, "]")
+            if host, _, err := net.SplitHostPort(val); err == nil {
+                val = host
+            }
+            fors = append(fors, val)
+        }
+    }
+    for i := len(fors) - 1; i >= 0; i-- {
+        addr, err := netip.ParseAddr(fors[i])
+        if err != nil {
+            continue
+        }
+        if !trusted.Contains(addr) {
+            return fors[i]
+        }
+    }
+    return ""
+}
+
+// -----------------
+// Backend selection
+// -----------------
+
+// BuildLimiter picks a Limiter implementation from cfg.RateLimitBackend
+// ("memory", the default, or "redis").
+func BuildLimiter(cfg AppConfig) (Limiter, error) {
+    switch strings.ToLower(cfg.RateLimitBackend) {
+    case "", "memory":
+        return NewTokenBucketLimiter(cfg.RateBurst, cfg.RateRefillPerSec), nil
+    case "redis":
+        if cfg.RedisAddr == "" {
+            return nil, fmt.Errorf("RATE_LIMIT_BACKEND=redis requires REDIS_ADDR")
+        }
+        return NewRedisLimiter(cfg.RedisAddr, cfg.RateBurst, cfg.RateRefillPerSec), nil
+    default:
+        return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", cfg.RateLimitBackend)
+    }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "net/netip"
+    "testing"
+    "time"
+)
+
+func mustTrusted(t *testing.T, cidrs ...string) TrustedProxies {
+    t.Helper()
+    tp, err := parseTrustedProxies(joinCSV(cidrs))
+    if err != nil {
+        t.Fatalf("parseTrustedProxies: %v", err)
+    }
+    return tp
+}
+
+func joinCSV(parts []string) string {
+    out := ""
+    for i, p := range parts {
+        if i > 0 {
+            out += ","
+        }
+        out += p
+    }
+    return out
+}
+
+func TestFirstUntrustedHop(t *testing.T) {
+    trusted := mustTrusted(t, "10.0.0.0/8")
+    cases := []struct {
+        name string
+        xff  string
+        want string
+    }{
+        {"single untrusted", "203.0.113.5", "203.0.113.5"},
+        {"client then trusted proxy", "203.0.113.5, 10.0.0.1", "203.0.113.5"},
+        {"spoofed client ignored behind trusted proxy", "10.0.0.1, 203.0.113.5", "203.0.113.5"},
+        {"all trusted", "10.0.0.1, 10.0.0.2", ""},
+        {"unparsable entries skipped", "203.0.113.5, not-an-ip", "203.0.113.5"},
+        {"empty", "", ""},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            got := firstUntrustedHop(c.xff, trusted)
+            if got != c.want {
+                t.Fatalf("firstUntrustedHop(%q) = %q, want %q", c.xff, got, c.want)
+            }
+        })
+    }
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+    trusted := mustTrusted(t, "10.0.0.0/8")
+    cases := []struct {
+        name   string
+        header string
+        want   string
+    }{
+        {"single for", `for=203.0.113.5`, "203.0.113.5"},
+        {"quoted with port", `for="203.0.113.5:1234"`, "203.0.113.5"},
+        {"ipv6 bracketed no port", `for="[2001:db8::1]"`, "2001:db8::1"},
+        {"multiple hops, trusted proxy last", `for=203.0.113.5;proto=https, for=10.0.0.1`, "203.0.113.5"},
+        {"no for value", `proto=https`, ""},
+    }
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            got := parseForwardedHeader(c.header, trusted)
+            if got != c.want {
+                t.Fatalf("parseForwardedHeader(%q) = %q, want %q", c.header, got, c.want)
+            }
+        })
+    }
+}
+
+func TestTokenBucketLimiterRefillMath(t *testing.T) {
+    l := NewTokenBucketLimiter(2, 1) // burst 2, refill 1 token/sec
+    defer l.Close()
+
+    ctx := t.Context()
+
+    d, err := l.Allow(ctx, "k")
+    if err != nil || !d.Allowed {
+        t.Fatalf("first Allow: allowed=%v err=%v, want allowed", d.Allowed, err)
+    }
+    d, err = l.Allow(ctx, "k")
+    if err != nil || !d.Allowed {
+        t.Fatalf("second Allow: allowed=%v err=%v, want allowed", d.Allowed, err)
+    }
+    d, err = l.Allow(ctx, "k")
+    if err != nil || d.Allowed {
+        t.Fatalf("third Allow: allowed=%v err=%v, want denied (bucket exhausted)", d.Allowed, err)
+    }
+
+    // Simulate refill by backdating the bucket's lastRefill directly
+    // rather than sleeping in the test.
+    l.mu.Lock()
+    l.buckets["k"].lastRefill = l.buckets["k"].lastRefill.Add(-1500 * time.Millisecond)
+    l.mu.Unlock()
+
+    d, err = l.Allow(ctx, "k")
+    if err != nil || !d.Allowed {
+        t.Fatalf("Allow after refill: allowed=%v err=%v, want allowed", d.Allowed, err)
+    }
+}
+
+func TestTokenBucketLimiterSweepEvictsIdleBuckets(t *testing.T) {
+    l := NewTokenBucketLimiter(1, 1)
+    defer l.Close()
+
+    if _, err := l.Allow(t.Context(), "idle"); err != nil {
+        t.Fatalf("Allow: %v", err)
+    }
+    if got := l.VisitorCount(); got != 1 {
+        t.Fatalf("VisitorCount = %d, want 1", got)
+    }
+
+    l.sweep(time.Now().Add(bucketIdleTTL + time.Second))
+
+    if got := l.VisitorCount(); got != 0 {
+        t.Fatalf("VisitorCount after sweep = %d, want 0", got)
+    }
+}
+
+func TestTrustedProxiesContains(t *testing.T) {
+    tp := mustTrusted(t, "192.168.1.0/24", "10.0.0.5")
+    in := netip.MustParseAddr("192.168.1.42")
+    out := netip.MustParseAddr("192.168.2.1")
+    if !tp.Contains(in) {
+        t.Fatalf("Contains(%v) = false, want true", in)
+    }
+    if tp.Contains(out) {
+        t.Fatalf("Contains(%v) = true, want false", out)
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// -----------------
+// OpenTelemetry tracing
+// -----------------
+
+// tracer is used by every span start across handlers/limiter/notifiers.
+var tracer = otel.Tracer("azurepulse")
+
+// initTracer wires up a TracerProvider exporting spans via OTLP/HTTP to
+// otlpEndpoint (e.g. a local Jaeger/Tempo collector), and registers the
+// W3C traceparent propagator globally so outbound calls can carry it.
+// An empty endpoint disables tracing: the global no-op TracerProvider
+// otel ships with by default is left in place, so every span start/end
+// call in this file is still safe, just inert.
+func initTracer(ctx context.Context, otlpEndpoint string) (shutdown func(context.Context) error, err error) {
+    otel.SetTextMapPropagator(propagation.TraceContext{})
+
+    if otlpEndpoint == "" {
+        return func(context.Context) error { return nil }, nil
+    }
+
+    exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(otlpEndpoint), otlptracehttp.WithInsecure())
+    if err != nil {
+        return nil, fmt.Errorf("otlp exporter: %w", err)
+    }
+
+    res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName("azurepulse")))
+    if err != nil {
+        return nil, fmt.Errorf("otel resource: %w", err)
+    }
+
+    tp := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(res),
+    )
+    otel.SetTracerProvider(tp)
+
+    return tp.Shutdown, nil
+}
+
+// injectTraceparent stamps the current span context from ctx onto an
+// outbound request as a standard W3C traceparent header, so a collector
+// can stitch the webhook/bot-API call into the request's trace.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+    otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// tracedHandler wraps an http.Handler in a span named after path, with
+// the incoming request's own traceparent (if any) as parent.
+func tracedHandler(path string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        ctx, span := tracer.Start(ctx, path, trace.WithAttributes(
+            attribute.String("http.method", r.Method),
+            attribute.String("http.target", r.URL.Path),
+        ))
+        defer span.End()
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}